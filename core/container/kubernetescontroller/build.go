@@ -0,0 +1,354 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kubernetescontroller
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	container "github.com/hyperledger/fabric/core/container/api"
+	"github.com/hyperledger/fabric/core/container/ccintf"
+	"github.com/spf13/viper"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultKanikoImage is used to build and push chaincode images when
+// peer.kubernetes.kanikoImage isn't set.
+const defaultKanikoImage = "gcr.io/kaniko-project/executor:latest"
+
+// defaultStagingImage fetches the chaincode package onto the build context
+// PVC before the Kaniko container runs. It only needs a shell and wget, so
+// it's deliberately tiny.
+const defaultStagingImage = "busybox:1.35"
+
+// defaultBuildTimeout bounds how long Start waits for the build Job to
+// finish when peer.kubernetes.buildTimeout isn't set.
+const defaultBuildTimeout = 10 * time.Minute
+
+// defaultBuildContextSize is the size requested for the PVC the chaincode
+// package is staged onto when peer.kubernetes.buildContextSize isn't set.
+const defaultBuildContextSize = "1Gi"
+
+// dockerfileTemplate extracts the binpackage tar produced by the chaincode
+// builder into /usr/local/bin of the configured runtime image, mirroring
+// what the peer previously did in the local docker build.
+const dockerfileTemplate = `FROM %s
+ADD binpackage.tar /usr/local/bin
+`
+
+// imageExistsTimeout bounds how long the registry manifest existence probe
+// may take before imageExists gives up and triggers a rebuild.
+const imageExistsTimeout = 5 * time.Second
+
+// manifestAcceptTypes is sent as the Accept header of the existence probe,
+// so a registry serving the schema2 or OCI manifests Kaniko pushes doesn't
+// 404 a request that only asks for the legacy v1 manifest.
+var manifestAcceptTypes = strings.Join([]string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}, ", ")
+
+// ensureImage returns the fully-qualified image reference for ccid,
+// building and pushing it with an in-cluster Kaniko Job first if it isn't
+// already present in peer.kubernetes.registry.
+func (vm *KubernetesVM) ensureImage(client kubernetes.Interface, namespace string, ccid ccintf.CCID, builder container.BuildSpecFactory) (string, error) {
+	registry := viper.GetString("peer.kubernetes.registry")
+	if registry == "" {
+		return "", fmt.Errorf("peer.kubernetes.registry must be set to build and push chaincode images")
+	}
+
+	reader, err := builder()
+	if err != nil {
+		return "", fmt.Errorf("building chaincode package for %s: %s", ccid.GetName(), err)
+	}
+
+	binpackage, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("reading chaincode package for %s: %s", ccid.GetName(), err)
+	}
+
+	hash := sha256.Sum256(binpackage)
+	repository := sanitizeRepository(ccid.Name)
+	tag := fmt.Sprintf("%s-%x", ccid.Version, hash[:8])
+	image := fmt.Sprintf("%s/%s:%s", registry, repository, tag)
+
+	if imageExists(registry, repository, tag) {
+		kubernetesLogger.Debugf("image %s already present in %s, skipping build", image, registry)
+		return image, nil
+	}
+
+	if err := vm.buildAndPush(client, namespace, ccid, image, binpackage); err != nil {
+		return "", err
+	}
+
+	return image, nil
+}
+
+// imageExists checks whether tag is already published for repository in
+// registry via the Docker Registry HTTP API v2 manifest endpoint, sending
+// manifestAcceptTypes so a registry doesn't 404 a request that only asks
+// for the legacy v1 manifest. Scheme is taken from
+// peer.kubernetes.registryInsecure so this also works against a plain-HTTP
+// registry, and the probe is bounded by imageExistsTimeout so a stalled
+// registry can't hang Start. Any outcome this unauthenticated HEAD can't
+// confirm - a network error, a timeout, or a registry demanding auth - is
+// treated as "not confirmed present" so the caller rebuilds rather than
+// risks skipping a build on a false positive.
+func imageExists(registry, repository, tag string) bool {
+	scheme := "https"
+	if viper.GetBool("peer.kubernetes.registryInsecure") {
+		scheme = "http"
+	}
+	url := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, registry, repository, tag)
+
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Accept", manifestAcceptTypes)
+
+	client := &http.Client{Timeout: imageExistsTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK
+}
+
+// buildAndPush stages binpackage onto a temporary PVC and runs a Kaniko Job
+// that builds and pushes image from it, blocking until the Job completes
+// and propagating its logs if it fails.
+func (vm *KubernetesVM) buildAndPush(client kubernetes.Interface, namespace string, ccid ccintf.CCID, image string, binpackage []byte) error {
+	jobName, err := vm.GetVMName(ccid, nil)
+	if err != nil {
+		return err
+	}
+	jobName = sanitizeRepository(jobName) + "-build"
+
+	address, err := buildContextAddress()
+	if err != nil {
+		return err
+	}
+
+	port, stopContextServer, err := serveBuildContext(binpackage)
+	if err != nil {
+		return fmt.Errorf("serving build context for %s: %s", jobName, err)
+	}
+	defer stopContextServer()
+
+	runtimeImage := viper.GetString("chaincode.golang.runtime")
+	dockerfile := fmt.Sprintf(dockerfileTemplate, runtimeImage)
+
+	dockerfileConfigMap := &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: jobName},
+		Data:       map[string]string{"Dockerfile": dockerfile},
+	}
+	configMapsClient := client.CoreV1().ConfigMaps(namespace)
+	if _, err := configMapsClient.Create(dockerfileConfigMap); err != nil {
+		return fmt.Errorf("staging Dockerfile for %s: %s", jobName, err)
+	}
+	defer configMapsClient.Delete(jobName, &metav1.DeleteOptions{})
+
+	contextSize := viper.GetString("peer.kubernetes.buildContextSize")
+	if contextSize == "" {
+		contextSize = defaultBuildContextSize
+	}
+
+	buildContext := &apiv1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: jobName},
+		Spec: apiv1.PersistentVolumeClaimSpec{
+			AccessModes: []apiv1.PersistentVolumeAccessMode{apiv1.ReadWriteOnce},
+			Resources: apiv1.ResourceRequirements{
+				Requests: apiv1.ResourceList{
+					apiv1.ResourceStorage: resource.MustParse(contextSize),
+				},
+			},
+		},
+	}
+	pvcsClient := client.CoreV1().PersistentVolumeClaims(namespace)
+	if _, err := pvcsClient.Create(buildContext); err != nil {
+		return fmt.Errorf("staging build context PVC for %s: %s", jobName, err)
+	}
+	defer pvcsClient.Delete(jobName, &metav1.DeleteOptions{})
+
+	kanikoImage := viper.GetString("peer.kubernetes.kanikoImage")
+	if kanikoImage == "" {
+		kanikoImage = defaultKanikoImage
+	}
+
+	stagingImage := viper.GetString("peer.kubernetes.stagingImage")
+	if stagingImage == "" {
+		stagingImage = defaultStagingImage
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: jobName},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: int32Ptr(0),
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"job-name": jobName},
+				},
+				Spec: apiv1.PodSpec{
+					RestartPolicy: apiv1.RestartPolicyNever,
+					InitContainers: []apiv1.Container{
+						{
+							// Pulls the chaincode package onto the PVC over
+							// HTTP instead of embedding it in the Job spec,
+							// since it can be tens of MB - far above the
+							// 1MiB etcd caps on Secrets/ConfigMaps.
+							Name:    "fetch-context",
+							Image:   stagingImage,
+							Command: []string{"wget", "-O", "/workspace/binpackage.tar", fmt.Sprintf("http://%s:%d/binpackage.tar", address, port)},
+							VolumeMounts: []apiv1.VolumeMount{
+								{Name: "build-context", MountPath: "/workspace"},
+							},
+						},
+					},
+					Containers: []apiv1.Container{
+						{
+							Name:  "kaniko",
+							Image: kanikoImage,
+							Args: []string{
+								"--context=dir:///workspace",
+								"--dockerfile=/dockerfile/Dockerfile",
+								fmt.Sprintf("--destination=%s", image),
+							},
+							VolumeMounts: []apiv1.VolumeMount{
+								{Name: "build-context", MountPath: "/workspace"},
+								{Name: "dockerfile", MountPath: "/dockerfile"},
+							},
+						},
+					},
+					Volumes: []apiv1.Volume{
+						{
+							Name: "build-context",
+							VolumeSource: apiv1.VolumeSource{
+								PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{ClaimName: jobName},
+							},
+						},
+						{
+							Name: "dockerfile",
+							VolumeSource: apiv1.VolumeSource{
+								ConfigMap: &apiv1.ConfigMapVolumeSource{LocalObjectReference: apiv1.LocalObjectReference{Name: jobName}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	jobsClient := client.BatchV1().Jobs(namespace)
+	if _, err := jobsClient.Create(job); err != nil {
+		return fmt.Errorf("starting build job %s: %s", jobName, err)
+	}
+	defer jobsClient.Delete(jobName, &metav1.DeleteOptions{PropagationPolicy: deletePropagationForegroundPtr()})
+
+	timeout := defaultBuildTimeout
+	if viper.IsSet("peer.kubernetes.buildTimeout") {
+		timeout = viper.GetDuration("peer.kubernetes.buildTimeout")
+	}
+
+	pollErr := wait.PollImmediate(readyPollInterval, timeout, func() (bool, error) {
+		current, err := jobsClient.Get(jobName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if current.Status.Succeeded > 0 {
+			return true, nil
+		}
+		if current.Status.Failed > 0 {
+			return false, fmt.Errorf("build job %s failed", jobName)
+		}
+		return false, nil
+	})
+
+	if pollErr != nil {
+		return fmt.Errorf("building image %s: %s; %s", image, pollErr, vm.buildJobLogs(client, namespace, jobName))
+	}
+
+	return nil
+}
+
+// buildContextAddress returns the address the build Job's fetch-context
+// init container can reach this process at, taken from
+// peer.kubernetes.buildContextAddress or, failing that, the Downward
+// API-populated POD_IP (set when the peer itself runs as a Pod in the
+// target cluster, the expected deployment for this feature).
+func buildContextAddress() (string, error) {
+	if address := viper.GetString("peer.kubernetes.buildContextAddress"); address != "" {
+		return address, nil
+	}
+	if address := os.Getenv("POD_IP"); address != "" {
+		return address, nil
+	}
+	return "", fmt.Errorf("peer.kubernetes.buildContextAddress or the POD_IP environment variable must be set so the build job can fetch the chaincode package")
+}
+
+// serveBuildContext starts a one-shot HTTP listener serving binpackage at
+// /binpackage.tar, so the build Job's init container can fetch it onto the
+// context PVC without it ever needing to fit inside a Secret or ConfigMap.
+// The caller must invoke the returned stop func once the build Job is done
+// with it.
+func serveBuildContext(binpackage []byte) (port int, stop func(), err error) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/binpackage.tar", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binpackage)
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+
+	return listener.Addr().(*net.TCPAddr).Port, func() { server.Close() }, nil
+}
+
+// buildJobLogs returns the kaniko container logs for jobName's pod, to
+// surface in the error returned when a build fails.
+func (vm *KubernetesVM) buildJobLogs(client kubernetes.Interface, namespace, jobName string) string {
+	pods, err := client.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("job-name=%s", jobName),
+	})
+	if err != nil || len(pods.Items) == 0 {
+		return fmt.Sprintf("could not fetch logs for build job %s: %s", jobName, err)
+	}
+
+	logs, err := client.CoreV1().Pods(namespace).
+		GetLogs(pods.Items[0].Name, &apiv1.PodLogOptions{Container: "kaniko"}).
+		Do().Raw()
+	if err != nil {
+		return fmt.Sprintf("could not fetch logs for build job %s: %s", jobName, err)
+	}
+
+	return string(logs)
+}
+
+func sanitizeRepository(name string) string {
+	return strings.ToLower(vmRegExp.ReplaceAllString(name, "-"))
+}
+
+func deletePropagationForegroundPtr() *metav1.DeletionPropagation {
+	policy := metav1.DeletePropagationForeground
+	return &policy
+}
@@ -0,0 +1,111 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package client
+
+import (
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// serviceAccountMapper resolves only the ServiceAccount kind these tests
+// exercise, standing in for the discovery-backed RESTMapper a real Cluster
+// builds.
+func serviceAccountMapper() meta.RESTMapper {
+	gv := apiv1.SchemeGroupVersion
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+	mapper.Add(gv.WithKind("ServiceAccount"), meta.RESTScopeNamespace)
+	return mapper
+}
+
+func dynamicScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	apiv1.AddToScheme(scheme)
+	return scheme
+}
+
+func newDiscoverableClientset() *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	clientset.Resources = []*metav1.APIResourceList{{GroupVersion: "apps/v1"}}
+	return clientset
+}
+
+func serviceAccountObject(name, namespace string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ServiceAccount",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+		},
+	}}
+}
+
+func TestCreateAlreadyExists(t *testing.T) {
+	clientset := newDiscoverableClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(dynamicScheme())
+
+	c, err := New(clientset.Discovery(), dynamicClient, serviceAccountMapper())
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err)
+	}
+
+	if err := c.Create("ns", serviceAccountObject("sa", "ns")); err != nil {
+		t.Fatalf("seeding existing ServiceAccount: %s", err)
+	}
+
+	err = c.Create("ns", serviceAccountObject("sa", "ns"))
+	if !apierrors.IsAlreadyExists(err) {
+		t.Fatalf("expected an AlreadyExists error, got %v", err)
+	}
+}
+
+func TestDeleteNotFoundIsNotAnError(t *testing.T) {
+	clientset := newDiscoverableClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(dynamicScheme())
+
+	c, err := New(clientset.Discovery(), dynamicClient, serviceAccountMapper())
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err)
+	}
+
+	err = c.Delete("ns", serviceAccountObject("missing", "ns"), metav1.DeletePropagationForeground)
+	if err != nil {
+		t.Fatalf("expected Delete of a missing object to be treated as success, got %s", err)
+	}
+}
+
+func TestApplyReplacesExistingObject(t *testing.T) {
+	clientset := newDiscoverableClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(dynamicScheme())
+
+	c, err := New(clientset.Discovery(), dynamicClient, serviceAccountMapper())
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err)
+	}
+
+	if err := c.Create("ns", serviceAccountObject("sa", "ns")); err != nil {
+		t.Fatalf("seeding existing ServiceAccount: %s", err)
+	}
+
+	if err := c.Apply("ns", []*unstructured.Unstructured{serviceAccountObject("sa", "ns")}); err != nil {
+		t.Fatalf("Apply returned an error: %s", err)
+	}
+
+	resource := schema.GroupVersionResource{Version: "v1", Resource: "serviceaccounts"}
+	if _, err := dynamicClient.Resource(resource).Namespace("ns").Get("sa", metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected the ServiceAccount to still exist after Apply: %s", err)
+	}
+}
@@ -9,19 +9,23 @@ package kubernetescontroller
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/common/flogging"
 	container "github.com/hyperledger/fabric/core/container/api"
 	"github.com/hyperledger/fabric/core/container/ccintf"
+	"github.com/hyperledger/fabric/core/container/kubernetescontroller/chart"
+	kubeclient "github.com/hyperledger/fabric/core/container/kubernetescontroller/client"
+	"github.com/hyperledger/fabric/core/container/kubernetescontroller/workload"
 	cutil "github.com/hyperledger/fabric/core/container/util"
 	"github.com/spf13/viper"
 	"golang.org/x/net/context"
-	appsv1beta1 "k8s.io/api/apps/v1beta1"
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
 var (
@@ -29,24 +33,66 @@ var (
 	vmRegExp         = regexp.MustCompile("[^a-zA-Z0-9-_.]")
 )
 
-// getClient returns an instance for kubernetes.Clientset
-type getClient func() (*kubernetes.Clientset, error)
+// defaultStartupTimeout bounds how long Start waits for the chaincode
+// workload to become ready when peer.kubernetes.startupTimeout isn't set.
+const defaultStartupTimeout = 60 * time.Second
+
+// defaultShutdownTimeout bounds how long stopInternal waits for the
+// chaincode workload's ReplicaSet(s) and Pods to terminate when
+// peer.kubernetes.shutdownTimeout isn't set.
+const defaultShutdownTimeout = 60 * time.Second
+
+// readyPollInterval is how often Start polls the API server while waiting
+// on the image build Job. Workload readiness and termination waits poll at
+// the workload package's own interval.
+const readyPollInterval = 2 * time.Second
+
+// clientCache memoizes the Cluster built for each peer.kubernetes.context,
+// so chaincodes addressed at the same cluster share one Clientset, dynamic
+// client and discovery cache instead of rebuilding them on every Start/Stop.
+var clientCache = cutil.NewClientCache()
+
+// Factory returns the Cluster for kubeContext, the name of a context within
+// peer.kubernetes.kubeconfig (an empty kubeContext uses the default
+// cluster). It exists so tests can inject a fake clientset via WithFactory.
+type Factory func(kubeContext string) (*cutil.Cluster, error)
+
+// defaultFactory looks up kubeContext in the shared clientCache.
+func defaultFactory(kubeContext string) (*cutil.Cluster, error) {
+	return clientCache.Get(kubeContext)
+}
+
+// Option configures a KubernetesVM returned by NewKubernetesVM.
+type Option func(*KubernetesVM)
+
+// WithFactory overrides how a KubernetesVM obtains its Clientset, e.g. to
+// inject a fake clientset in tests.
+func WithFactory(factory Factory) Option {
+	return func(vm *KubernetesVM) {
+		vm.factory = factory
+	}
+}
 
 // KubernetesVM is a vm. It is identified by an image id
 type KubernetesVM struct {
-	id           string
-	getClientFnc getClient
+	id      string
+	factory Factory
 }
 
 // NewKubernetesVM returns a new KubernetesVM instance
-func NewKubernetesVM() *KubernetesVM {
-	vm := KubernetesVM{}
-	vm.getClientFnc = getKubernetesClient
-	return &vm
+func NewKubernetesVM(opts ...Option) *KubernetesVM {
+	vm := &KubernetesVM{factory: defaultFactory}
+	for _, opt := range opts {
+		opt(vm)
+	}
+	return vm
 }
 
-func getKubernetesClient() (*kubernetes.Clientset, error) {
-	return cutil.NewKubernetesClient()
+// kubeContext returns the kubeconfig context chaincode workloads are
+// addressed at, configurable via peer.kubernetes.context for multi-cluster
+// deployments.
+func (vm *KubernetesVM) kubeContext() string {
+	return viper.GetString("peer.kubernetes.context")
 }
 
 //Deploy not used yet
@@ -59,11 +105,12 @@ func (vm *KubernetesVM) Deploy(ctxt context.Context, ccid ccintf.CCID,
 func (vm *KubernetesVM) Start(ctxt context.Context, ccid ccintf.CCID,
 	args []string, env []string, builder container.BuildSpecFactory, prelaunchFunc container.PrelaunchFunc) error {
 
-	client, err := vm.getClientFnc()
+	cluster, err := vm.factory(vm.kubeContext())
 	if err != nil {
 		kubernetesLogger.Debugf("start - cannot create client %s", err)
 		return err
 	}
+	client := cluster.Clientset
 
 	deploymentID, err := vm.GetVMName(ccid, nil)
 	if err != nil {
@@ -72,7 +119,7 @@ func (vm *KubernetesVM) Start(ctxt context.Context, ccid ccintf.CCID,
 
 	// Delete the deployment if is running
 	kubernetesLogger.Debugf("Cleanup deployment %s", deploymentID)
-	vm.stopInternal(ctxt, client, deploymentID, 0, false, false)
+	vm.stopInternal(ctxt, cluster, ccid, 0, false, false)
 
 	namespace := apiv1.NamespaceDefault
 
@@ -80,106 +127,231 @@ func (vm *KubernetesVM) Start(ctxt context.Context, ccid ccintf.CCID,
 		namespace = viper.GetString("peer.kubernetes.namespace")
 	}
 
-	runtimeImage := viper.GetString("chaincode.golang.runtime")
-
-	kubernetesLogger.Debugf("Start deployment %s at namespace %d and runtime %s", deploymentID, namespace, runtimeImage)
-
-	// Create a deployment with 1 container using args/envs received
-	// builder will contain a targz with binpackage
-	// that must be extracted in /usr/local/bin
-	// after that command received in envs must be executed
-	// TODO read dockerfile to get LABELs and ENV CORE_PEER_TLS_ROOTCERT_FILE
-	deploymentsClient := client.AppsV1beta1().Deployments(namespace)
-
-	deployment := &appsv1beta1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: deploymentID,
-		},
-		Spec: appsv1beta1.DeploymentSpec{
-			Replicas: int32Ptr(1),
-			Template: apiv1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": "fabric",
-						"org.hyperledger.fabric.base.version":         "0.3.2",
-						"org.hyperledger.fabric.chaincode.id.name":    "mycc",
-						"org.hyperledger.fabric.chaincode.id.version": "1.0",
-						"org.hyperledger.fabric.chaincode.type":       "GOLANG",
-						"org.hyperledger.fabric.version":              "1.0.4",
-					},
-				},
-				Spec: apiv1.PodSpec{
-					Containers: []apiv1.Container{
-						{
-							Name:    "fabric-chaincode-mycc-container",
-							Image:   "hub.estaleiro.serpro/bilhetador/fabric-chaincode-mycc:1.0",
-							Command: []string{"chaincode", "-peer.address=peer0:7051"},
-							Env: []apiv1.EnvVar{
-								{Name: "CORE_CHAINCODE_ID_NAME", Value: "mycc:1.0"},
-								{Name: "CORE_PEER_TLS_ENABLED", Value: "true"},
-								{Name: "CORE_CHAINCODE_LOGGING_LEVEL", Value: "info"},
-								{Name: "CORE_CHAINCODE_LOGGING_SHIM", Value: "warning"},
-								{Name: "CORE_CHAINCCORE_CHAINCODE_LOGGING_FORMATODE_ID_NAME", Value: "%{color}%{time:2006-01-02 15:04:05.000 MST} [%{module}] %{shortfunc} -> %{level:.4s} %{id:03x}%{color:reset} %{message}"},
-								{Name: "PATH", Value: "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
-								{Name: "CORE_CHAINCODE_BUILDLEVEL", Value: "1.0.4"},
-								{Name: "CORE_PEER_TLS_ROOTCERT_FILE", Value: "/etc/hyperledger/fabric/peer.crt"},
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	// Create Deployment
-	_, err = deploymentsClient.Create(deployment)
-	if err != nil {
-		kubernetesLogger.Errorf("start-could not create deployment <%s>, because of %s", deploymentID, err)
+	chartPath := viper.GetString("peer.kubernetes.chartPath")
+	if chartPath == "" {
+		return fmt.Errorf("peer.kubernetes.chartPath must be set to a chaincode chart directory")
+	}
+
+	kind, err := workload.ParseKind(viper.GetString("peer.kubernetes.workloadKind"))
+	if err != nil {
+		return err
+	}
+
+	kubernetesLogger.Debugf("Start %s %s at namespace %s using chart %s", kind.ObjectKind(), deploymentID, namespace, chartPath)
+
+	chrt, err := chart.Load(chartPath)
+	if err != nil {
+		kubernetesLogger.Errorf("start - cannot load chart %s, because of %s", chartPath, err)
+		return err
+	}
+
+	image, err := vm.ensureImage(client, namespace, ccid, builder)
+	if err != nil {
+		kubernetesLogger.Errorf("start - cannot build image for %s, because of %s", deploymentID, err)
+		return err
+	}
+
+	values, err := vm.chartValues(ccid, env, namespace)
+	if err != nil {
+		return err
+	}
+	values.Image = image
+
+	objects, err := chrt.Render(values)
+	if err != nil {
+		kubernetesLogger.Errorf("start - cannot render chart %s, because of %s", chartPath, err)
 		return err
 	}
 
+	objClient, err := kubeclient.New(cluster.Discovery, cluster.Dynamic, cluster.Mapper)
+	if err != nil {
+		return err
+	}
+
+	// Apply the rendered objects in dependency order so that, e.g., a
+	// ServiceAccount referenced by the Deployment already exists.
+	if err := objClient.Apply(namespace, objects); err != nil {
+		kubernetesLogger.Errorf("start - could not apply chart %s for deployment %s, because of %s", chartPath, deploymentID, err)
+		return err
+	}
+
+	workloadObj := findObjectByKind(objects, kind.ObjectKind())
+	if workloadObj != nil {
+		wl, err := workload.New(kind, workloadObj)
+		if err != nil {
+			return err
+		}
+
+		if err := wl.Wait(client, namespace, vm.startupTimeout()); err != nil {
+			kubernetesLogger.Errorf("start - %s %s never became ready, rolling back: %s", kind.ObjectKind(), deploymentID, err)
+			// Roll back every object the chart applied, not just the
+			// primary workload, so a timed-out Start doesn't orphan its
+			// Service/ConfigMap/ServiceAccount/etc.
+			if rollbackErr := objClient.DeleteAll(namespace, objects, metav1.DeletePropagationForeground); rollbackErr != nil {
+				kubernetesLogger.Errorf("start - rollback of chart %s for %s failed: %s", chartPath, deploymentID, rollbackErr)
+			}
+			return err
+		}
+	}
+
 	kubernetesLogger.Debugf("Started deployment %s", deploymentID)
 
 	return nil
 }
 
+// startupTimeout returns how long Start should wait for a chaincode
+// workload to become ready, configurable via peer.kubernetes.startupTimeout.
+func (vm *KubernetesVM) startupTimeout() time.Duration {
+	if viper.IsSet("peer.kubernetes.startupTimeout") {
+		return viper.GetDuration("peer.kubernetes.startupTimeout")
+	}
+	return defaultStartupTimeout
+}
+
+// shutdownTimeout returns how long stopInternal should wait for the
+// chaincode workload to terminate, configurable via
+// peer.kubernetes.shutdownTimeout.
+func (vm *KubernetesVM) shutdownTimeout() time.Duration {
+	if viper.IsSet("peer.kubernetes.shutdownTimeout") {
+		return viper.GetDuration("peer.kubernetes.shutdownTimeout")
+	}
+	return defaultShutdownTimeout
+}
+
+func findObjectByKind(objects []*unstructured.Unstructured, kind string) *unstructured.Unstructured {
+	for _, obj := range objects {
+		if obj.GetKind() == kind {
+			return obj
+		}
+	}
+	return nil
+}
+
+// chartValues builds the template context passed to the chaincode chart,
+// sourced from the CCID, the chaincode environment and operator overrides
+// configured under peer.kubernetes in core.yaml.
+func (vm *KubernetesVM) chartValues(ccid ccintf.CCID, env []string, namespace string) (chart.Values, error) {
+	envMap := make(map[string]string, len(env))
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			envMap[parts[0]] = parts[1]
+		}
+	}
+
+	// PeerTLSRootCert is embedded into chart objects (e.g. a Secret mounted
+	// into the chaincode container), so the chart needs the certificate's
+	// PEM contents, not the path it's configured with.
+	rootCertFile := viper.GetString("peer.tls.rootcert.file")
+	rootCert, err := ioutil.ReadFile(rootCertFile)
+	if err != nil {
+		return chart.Values{}, fmt.Errorf("reading peer.tls.rootcert.file %q: %s", rootCertFile, err)
+	}
+
+	return chart.Values{
+		NetworkID:        ccid.NetworkID,
+		PeerID:           ccid.PeerID,
+		ChaincodeName:    ccid.Name,
+		ChaincodeVersion: ccid.Version,
+		ChaincodeType:    ccid.Type,
+		Namespace:        namespace,
+		PeerTLSRootCert:  string(rootCert),
+		Env:              envMap,
+		Overrides:        viper.GetStringMap("peer.kubernetes.chartOverrides"),
+	}, nil
+}
+
 //Stop stops a running chaincode
 func (vm *KubernetesVM) Stop(ctxt context.Context, ccid ccintf.CCID, timeout uint, dontkill bool, dontremove bool) error {
-	id, err := vm.GetVMName(ccid, nil)
+	_, err := vm.GetVMName(ccid, nil)
 	if err != nil {
 		return err
 	}
 
-	client, err := vm.getClientFnc()
+	cluster, err := vm.factory(vm.kubeContext())
 	if err != nil {
 		kubernetesLogger.Debugf("stop - cannot create client %s", err)
 		return err
 	}
-	id = strings.Replace(id, ":", "_", -1)
 
-	err = vm.stopInternal(ctxt, client, id, timeout, dontkill, dontremove)
+	err = vm.stopInternal(ctxt, cluster, ccid, timeout, dontkill, dontremove)
 
 	return err
 }
 
-func (vm *KubernetesVM) stopInternal(ctxt context.Context, client *kubernetes.Clientset,
-	id string, timeout uint, dontkill bool, dontremove bool) error {
+// stopInternal deletes every object rendered from the chaincode's chart, in
+// the reverse of their install order, then waits for the primary workload's
+// Pods to terminate.
+func (vm *KubernetesVM) stopInternal(ctxt context.Context, cluster *cutil.Cluster,
+	ccid ccintf.CCID, timeout uint, dontkill bool, dontremove bool) error {
 
-	deploymentsClient := client.AppsV1beta1().Deployments(apiv1.NamespaceDefault)
+	client := cluster.Clientset
 
-	deletePolicy := metav1.DeletePropagationForeground
+	id, err := vm.GetVMName(ccid, nil)
+	if err != nil {
+		return err
+	}
+	id = strings.Replace(id, ":", "_", -1)
+
+	namespace := apiv1.NamespaceDefault
+	if viper.IsSet("peer.kubernetes.namespace") {
+		namespace = viper.GetString("peer.kubernetes.namespace")
+	}
+
+	chartPath := viper.GetString("peer.kubernetes.chartPath")
+	if chartPath == "" {
+		// nothing was ever rendered without a chart, so there's nothing to clean up
+		return nil
+	}
+
+	kind, err := workload.ParseKind(viper.GetString("peer.kubernetes.workloadKind"))
+	if err != nil {
+		return err
+	}
 
-	err := deploymentsClient.Delete(id, &metav1.DeleteOptions{
-		PropagationPolicy: &deletePolicy,
-	})
+	chrt, err := chart.Load(chartPath)
+	if err != nil {
+		kubernetesLogger.Debugf("stop - cannot load chart %s to compute cleanup objects: %s", chartPath, err)
+		return err
+	}
 
+	values, err := vm.chartValues(ccid, nil, namespace)
+	if err != nil {
+		return err
+	}
+
+	objects, err := chrt.Render(values)
+	if err != nil {
+		return err
+	}
+
+	objClient, err := kubeclient.New(cluster.Discovery, cluster.Dynamic, cluster.Mapper)
+	if err != nil {
+		return err
+	}
+
+	deletePolicy := metav1.DeletePropagationForeground
+
+	err = objClient.DeleteAll(namespace, objects, deletePolicy)
 	if err != nil {
 		kubernetesLogger.Debugf("Delete deployment %s (%s)", id, err)
-	} else {
-		kubernetesLogger.Debugf("Deleted deployment %s", id)
+		return err
 	}
 
-	return err
+	workloadObj := findObjectByKind(objects, kind.ObjectKind())
+	if workloadObj != nil {
+		wl, err := workload.New(kind, workloadObj)
+		if err == nil {
+			if err := wl.Gone(client, namespace, vm.shutdownTimeout()); err != nil {
+				kubernetesLogger.Debugf("stop - pods for %s did not terminate in time: %s", id, err)
+				return err
+			}
+		}
+	}
+
+	kubernetesLogger.Debugf("Deleted deployment %s", id)
+
+	return nil
 }
 
 //Destroy not used yet
@@ -0,0 +1,339 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package kubernetescontroller
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	container "github.com/hyperledger/fabric/core/container/api"
+	"github.com/hyperledger/fabric/core/container/ccintf"
+	kubeclient "github.com/hyperledger/fabric/core/container/kubernetescontroller/client"
+	cutil "github.com/hyperledger/fabric/core/container/util"
+	"github.com/spf13/viper"
+	"golang.org/x/net/context"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	memory "k8s.io/client-go/discovery/cached/memory"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+const deploymentTemplate = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ .ChaincodeName }}
+  namespace: {{ .Namespace }}
+  labels:
+    app: {{ .ChaincodeName }}
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: {{ .ChaincodeName }}
+  template:
+    metadata:
+      labels:
+        app: {{ .ChaincodeName }}
+    spec:
+      containers:
+      - name: chaincode
+        image: {{ .Image }}
+        env:
+        {{- range $k, $v := .Env }}
+        - name: {{ $k }}
+          value: {{ $v | quote }}
+        {{- end }}
+`
+
+// deploymentGVR is the dynamic resource the tests seed/inspect Deployments
+// through, mirroring how kubeclient.Client now addresses every chart object.
+var deploymentGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+// newTestChart writes a single-template chart that renders a Deployment, and
+// returns the directory it lives in.
+func newTestChart(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "kubernetescontroller-chart")
+	if err != nil {
+		t.Fatalf("creating chart fixture dir: %s", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "10-deployment.yaml"), []byte(deploymentTemplate), 0600); err != nil {
+		t.Fatalf("writing chart fixture: %s", err)
+	}
+
+	return dir
+}
+
+// deploymentMapper resolves only the Deployment kind these tests exercise,
+// standing in for the discovery-backed RESTMapper a real Cluster builds.
+func deploymentMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{appsv1.SchemeGroupVersion})
+	mapper.Add(appsv1.SchemeGroupVersion.WithKind("Deployment"), meta.RESTScopeNamespace)
+	return mapper
+}
+
+// newTestCluster wraps clientset into a Cluster backed by a dynamic fake
+// client, so Start/Stop can apply and delete chart objects the same way
+// they do against a real cluster.
+func newTestCluster(clientset *fake.Clientset) *cutil.Cluster {
+	scheme := runtime.NewScheme()
+	appsv1.AddToScheme(scheme)
+
+	return &cutil.Cluster{
+		Clientset: clientset,
+		Dynamic:   dynamicfake.NewSimpleDynamicClient(scheme),
+		Discovery: memory.NewMemCacheClient(clientset.Discovery()),
+		Mapper:    deploymentMapper(),
+	}
+}
+
+// newReadyClientset returns a fake clientset that reports apps/v1 discovery
+// support, and fakes out the build Job and the Deployment readiness check so
+// Start doesn't block on either.
+func newReadyClientset() *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	clientset.Resources = []*metav1.APIResourceList{{GroupVersion: "apps/v1"}}
+
+	clientset.PrependReactor("get", "jobs", func(action ktesting.Action) (bool, runtime.Object, error) {
+		get := action.(ktesting.GetAction)
+		obj, err := clientset.Tracker().Get(action.GetResource(), action.GetNamespace(), get.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		job := obj.(*batchv1.Job)
+		job.Status.Succeeded = 1
+		return true, job, nil
+	})
+
+	// The Deployment itself is now created through the dynamic client, not
+	// this typed clientset, so fabricate a ready status for any name
+	// instead of looking one up in this clientset's own tracker.
+	clientset.PrependReactor("get", "deployments", func(action ktesting.Action) (bool, runtime.Object, error) {
+		get := action.(ktesting.GetAction)
+		return true, &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: get.GetName(), Namespace: action.GetNamespace()},
+			Status:     appsv1.DeploymentStatus{AvailableReplicas: 1},
+		}, nil
+	})
+
+	return clientset
+}
+
+// seedReadyPod adds a Pod matching appLabel whose conditions report it as
+// scheduled, ready and with containers ready, so Wait's Pod-condition check
+// is satisfied alongside the Deployment's replica counts.
+func seedReadyPod(t *testing.T, clientset *fake.Clientset, namespace, appLabel string) {
+	t.Helper()
+
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      appLabel + "-pod",
+			Namespace: namespace,
+			Labels:    map[string]string{"app": appLabel},
+		},
+		Status: apiv1.PodStatus{
+			Phase: apiv1.PodRunning,
+			Conditions: []apiv1.PodCondition{
+				{Type: apiv1.PodScheduled, Status: apiv1.ConditionTrue},
+				{Type: apiv1.ContainersReady, Status: apiv1.ConditionTrue},
+				{Type: apiv1.PodReady, Status: apiv1.ConditionTrue},
+			},
+		},
+	}
+
+	if _, err := clientset.CoreV1().Pods(namespace).Create(pod); err != nil {
+		t.Fatalf("seeding ready pod: %s", err)
+	}
+}
+
+func TestStartCreatesDeployment(t *testing.T) {
+	clientset := newReadyClientset()
+	seedReadyPod(t, clientset, "default", "mycc")
+	cluster := newTestCluster(clientset)
+
+	chartPath := newTestChart(t)
+	defer os.RemoveAll(chartPath)
+
+	rootCertFile := filepath.Join(chartPath, "peer.crt")
+	if err := ioutil.WriteFile(rootCertFile, []byte("fake PEM cert"), 0600); err != nil {
+		t.Fatalf("writing root cert fixture: %s", err)
+	}
+
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("peer.kubernetes.chartPath", chartPath)
+	// port 0 is never listening, so the registry check fails fast without
+	// depending on an external network.
+	viper.Set("peer.kubernetes.registry", "127.0.0.1:0")
+	viper.Set("peer.kubernetes.buildContextAddress", "127.0.0.1")
+	viper.Set("peer.tls.rootcert.file", rootCertFile)
+
+	vm := NewKubernetesVM(WithFactory(func(string) (*cutil.Cluster, error) {
+		return cluster, nil
+	}))
+
+	ccid := ccintf.CCID{Name: "mycc", Version: "1.0", Type: "GOLANG"}
+	env := []string{"CORE_CHAINCODE_ID_NAME=mycc:1.0", "CORE_PEER_TLS_ENABLED=false"}
+	builder := container.BuildSpecFactory(func() (io.Reader, error) {
+		return strings.NewReader("fake chaincode package"), nil
+	})
+
+	if err := vm.Start(context.Background(), ccid, nil, env, builder, nil); err != nil {
+		t.Fatalf("Start returned an error: %s", err)
+	}
+
+	obj, err := cluster.Dynamic.Resource(deploymentGVR).Namespace("default").Get("mycc", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected a Deployment named %q, got error: %s", "mycc", err)
+	}
+
+	deployment := &appsv1.Deployment{}
+	if err := kubeclient.FromUnstructured(obj, deployment); err != nil {
+		t.Fatalf("decoding applied Deployment: %s", err)
+	}
+
+	if deployment.Labels["app"] != "mycc" {
+		t.Fatalf("expected label app=mycc, got %q", deployment.Labels["app"])
+	}
+
+	containers := deployment.Spec.Template.Spec.Containers
+	if len(containers) != 1 {
+		t.Fatalf("expected exactly one container, got %d", len(containers))
+	}
+	if !strings.Contains(containers[0].Image, "mycc") {
+		t.Fatalf("expected image to reference the built chaincode image, got %q", containers[0].Image)
+	}
+
+	gotEnv := map[string]string{}
+	for _, e := range containers[0].Env {
+		gotEnv[e.Name] = e.Value
+	}
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if gotEnv[parts[0]] != parts[1] {
+			t.Errorf("expected container env %s=%s, got %q", parts[0], parts[1], gotEnv[parts[0]])
+		}
+	}
+}
+
+func TestStopDeletesDeploymentWithForegroundPropagation(t *testing.T) {
+	clientset := newReadyClientset()
+	cluster := newTestCluster(clientset)
+
+	var gotPropagation *metav1.DeletionPropagation
+	cluster.Dynamic.(*dynamicfake.FakeDynamicClient).PrependReactor("delete", "deployments", func(action ktesting.Action) (bool, runtime.Object, error) {
+		del := action.(ktesting.DeleteActionImpl)
+		gotPropagation = del.DeleteOptions.PropagationPolicy
+		return false, nil, nil
+	})
+
+	chartPath := newTestChart(t)
+	defer os.RemoveAll(chartPath)
+
+	rootCertFile := filepath.Join(chartPath, "peer.crt")
+	if err := ioutil.WriteFile(rootCertFile, []byte("fake PEM cert"), 0600); err != nil {
+		t.Fatalf("writing root cert fixture: %s", err)
+	}
+
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("peer.kubernetes.chartPath", chartPath)
+	viper.Set("peer.tls.rootcert.file", rootCertFile)
+
+	vm := NewKubernetesVM(WithFactory(func(string) (*cutil.Cluster, error) {
+		return cluster, nil
+	}))
+
+	ccid := ccintf.CCID{Name: "mycc", Version: "1.0"}
+
+	existing := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":      "mycc",
+			"namespace": "default",
+		},
+	}}
+	if _, err := cluster.Dynamic.Resource(deploymentGVR).Namespace("default").Create(existing); err != nil {
+		t.Fatalf("seeding existing Deployment: %s", err)
+	}
+
+	if err := vm.Stop(context.Background(), ccid, 0, false, false); err != nil {
+		t.Fatalf("Stop returned an error: %s", err)
+	}
+
+	if gotPropagation == nil || *gotPropagation != metav1.DeletePropagationForeground {
+		t.Fatalf("expected the Deployment to be deleted with foreground propagation, got %v", gotPropagation)
+	}
+
+	if _, err := cluster.Dynamic.Resource(deploymentGVR).Namespace("default").Get("mycc", metav1.GetOptions{}); err == nil {
+		t.Fatalf("expected the Deployment to be gone after Stop")
+	}
+}
+
+func TestGetVMName(t *testing.T) {
+	vm := NewKubernetesVM()
+
+	tests := []struct {
+		name     string
+		ccid     ccintf.CCID
+		expected string
+	}{
+		{
+			name:     "name only",
+			ccid:     ccintf.CCID{Name: "mycc"},
+			expected: "mycc",
+		},
+		{
+			name:     "network and peer id",
+			ccid:     ccintf.CCID{Name: "mycc", NetworkID: "net1", PeerID: "peer1"},
+			expected: "net1-peer1-mycc",
+		},
+		{
+			name:     "network id only",
+			ccid:     ccintf.CCID{Name: "mycc", NetworkID: "net1"},
+			expected: "net1-mycc",
+		},
+		{
+			name:     "peer id only",
+			ccid:     ccintf.CCID{Name: "mycc", PeerID: "peer1"},
+			expected: "peer1-mycc",
+		},
+		{
+			name:     "invalid characters are sanitized",
+			ccid:     ccintf.CCID{Name: "my/cc", NetworkID: "net 1", PeerID: "peer#1"},
+			expected: "net-1-peer-1-my-cc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := vm.GetVMName(tt.ccid, nil)
+			if err != nil {
+				t.Fatalf("GetVMName returned an error: %s", err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package workload lets a chaincode select which Kubernetes resource its
+// chart's primary object renders as: a Deployment (the default), a
+// StatefulSet for chaincodes that need stable identity or PVCs, or a Job
+// for one-shot init chaincodes. Each Kind has a Workload implementation
+// that knows how to wait for it to become ready and how to tear it down,
+// so the rest of the controller doesn't need to special-case the kind.
+package workload
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	kubeclient "github.com/hyperledger/fabric/core/container/kubernetescontroller/client"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Kind selects which Kubernetes resource a chaincode's chart renders its
+// primary workload as.
+type Kind string
+
+const (
+	Deployment  Kind = "deployment"
+	StatefulSet Kind = "statefulset"
+	Job         Kind = "job"
+)
+
+// pollInterval is how often Wait/Gone poll the API server.
+const pollInterval = 2 * time.Second
+
+// ParseKind parses the peer.kubernetes.workloadKind configuration value,
+// defaulting to Deployment for an empty string.
+func ParseKind(s string) (Kind, error) {
+	switch Kind(strings.ToLower(s)) {
+	case "", Deployment:
+		return Deployment, nil
+	case StatefulSet:
+		return StatefulSet, nil
+	case Job:
+		return Job, nil
+	default:
+		return "", fmt.Errorf("unsupported peer.kubernetes.workloadKind %q", s)
+	}
+}
+
+// ObjectKind is the Kubernetes object Kind a chart must render for this
+// workload, e.g. "StatefulSet".
+func (k Kind) ObjectKind() string {
+	switch k {
+	case StatefulSet:
+		return "StatefulSet"
+	case Job:
+		return "Job"
+	default:
+		return "Deployment"
+	}
+}
+
+// Workload waits for and tears down the primary workload object rendered
+// by a chaincode's chart. obj has already been applied by kubeclient.Client
+// as part of the chart; Create exists for symmetry and reuse outside that
+// flow (e.g. tests).
+type Workload interface {
+	// Name returns the workload object's name.
+	Name() string
+	// Create creates the workload object.
+	Create(client *kubeclient.Client, namespace string) error
+	// Delete removes the workload object, honoring propagation.
+	Delete(client *kubeclient.Client, namespace string, propagation metav1.DeletionPropagation) error
+	// Wait blocks until the workload is ready (Deployment/StatefulSet) or
+	// has completed (Job), or timeout elapses.
+	Wait(client kubernetes.Interface, namespace string, timeout time.Duration) error
+	// Gone blocks until the workload's Pods have terminated, or timeout
+	// elapses.
+	Gone(client kubernetes.Interface, namespace string, timeout time.Duration) error
+}
+
+// New returns the Workload implementation for kind, backed by obj, the
+// object of that kind rendered from the chaincode's chart.
+func New(kind Kind, obj *unstructured.Unstructured) (Workload, error) {
+	switch kind {
+	case StatefulSet:
+		statefulSet := &appsv1.StatefulSet{}
+		if err := kubeclient.FromUnstructured(obj, statefulSet); err != nil {
+			return nil, err
+		}
+		return &statefulSetWorkload{obj: obj, statefulSet: statefulSet}, nil
+	case Job:
+		job := &batchv1.Job{}
+		if err := kubeclient.FromUnstructured(obj, job); err != nil {
+			return nil, err
+		}
+		return &jobWorkload{obj: obj, job: job}, nil
+	default:
+		deployment := &appsv1.Deployment{}
+		if err := kubeclient.FromUnstructured(obj, deployment); err != nil {
+			return nil, err
+		}
+		return &deploymentWorkload{obj: obj, deployment: deployment}, nil
+	}
+}
+
+type deploymentWorkload struct {
+	obj        *unstructured.Unstructured
+	deployment *appsv1.Deployment
+}
+
+func (w *deploymentWorkload) Name() string { return w.deployment.Name }
+
+func (w *deploymentWorkload) Create(client *kubeclient.Client, namespace string) error {
+	return client.Create(namespace, w.obj)
+}
+
+func (w *deploymentWorkload) Delete(client *kubeclient.Client, namespace string, propagation metav1.DeletionPropagation) error {
+	return client.Delete(namespace, w.obj, propagation)
+}
+
+func (w *deploymentWorkload) Wait(client kubernetes.Interface, namespace string, timeout time.Duration) error {
+	desired := int32(1)
+	if w.deployment.Spec.Replicas != nil {
+		desired = *w.deployment.Spec.Replicas
+	}
+
+	return waitReady(timeout, func() (bool, error) {
+		current, err := client.AppsV1().Deployments(namespace).Get(w.deployment.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if current.Status.ObservedGeneration < current.Generation {
+			return false, nil
+		}
+		if current.Status.AvailableReplicas < desired {
+			return false, nil
+		}
+		return podsReady(client, namespace, w.deployment.Spec.Template.Labels)
+	}, func() string {
+		return diagnose(client, namespace, w.deployment.Spec.Template.Labels)
+	})
+}
+
+func (w *deploymentWorkload) Gone(client kubernetes.Interface, namespace string, timeout time.Duration) error {
+	return waitReplicaSetsAndPodsGone(client, namespace, w.deployment.Spec.Template.Labels, timeout)
+}
+
+type statefulSetWorkload struct {
+	obj         *unstructured.Unstructured
+	statefulSet *appsv1.StatefulSet
+}
+
+func (w *statefulSetWorkload) Name() string { return w.statefulSet.Name }
+
+func (w *statefulSetWorkload) Create(client *kubeclient.Client, namespace string) error {
+	return client.Create(namespace, w.obj)
+}
+
+func (w *statefulSetWorkload) Delete(client *kubeclient.Client, namespace string, propagation metav1.DeletionPropagation) error {
+	return client.Delete(namespace, w.obj, propagation)
+}
+
+func (w *statefulSetWorkload) Wait(client kubernetes.Interface, namespace string, timeout time.Duration) error {
+	desired := int32(1)
+	if w.statefulSet.Spec.Replicas != nil {
+		desired = *w.statefulSet.Spec.Replicas
+	}
+
+	return waitReady(timeout, func() (bool, error) {
+		current, err := client.AppsV1().StatefulSets(namespace).Get(w.statefulSet.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if current.Status.ObservedGeneration < current.Generation {
+			return false, nil
+		}
+		if current.Status.ReadyReplicas < desired {
+			return false, nil
+		}
+		return podsReady(client, namespace, w.statefulSet.Spec.Template.Labels)
+	}, func() string {
+		return diagnose(client, namespace, w.statefulSet.Spec.Template.Labels)
+	})
+}
+
+func (w *statefulSetWorkload) Gone(client kubernetes.Interface, namespace string, timeout time.Duration) error {
+	return waitGone(client, namespace, w.statefulSet.Spec.Template.Labels, timeout)
+}
+
+type jobWorkload struct {
+	obj *unstructured.Unstructured
+	job *batchv1.Job
+}
+
+func (w *jobWorkload) Name() string { return w.job.Name }
+
+func (w *jobWorkload) Create(client *kubeclient.Client, namespace string) error {
+	return client.Create(namespace, w.obj)
+}
+
+func (w *jobWorkload) Delete(client *kubeclient.Client, namespace string, propagation metav1.DeletionPropagation) error {
+	return client.Delete(namespace, w.obj, propagation)
+}
+
+// Wait blocks until the Job has completed, rather than until it has
+// available replicas: a one-shot init chaincode is "ready" when it exits
+// successfully.
+func (w *jobWorkload) Wait(client kubernetes.Interface, namespace string, timeout time.Duration) error {
+	return waitReady(timeout, func() (bool, error) {
+		current, err := client.BatchV1().Jobs(namespace).Get(w.job.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if current.Status.Failed > 0 {
+			return false, fmt.Errorf("job %s failed", w.job.Name)
+		}
+		return current.Status.Succeeded > 0, nil
+	}, func() string {
+		return diagnose(client, namespace, w.job.Spec.Template.Labels)
+	})
+}
+
+func (w *jobWorkload) Gone(client kubernetes.Interface, namespace string, timeout time.Duration) error {
+	return waitGone(client, namespace, w.job.Spec.Template.Labels, timeout)
+}
+
+// waitReady polls condition until it returns true, an error, or timeout
+// elapses. On timeout it appends diagnose's output to the returned error.
+func waitReady(timeout time.Duration, condition wait.ConditionFunc, diagnose func() string) error {
+	err := wait.PollImmediate(pollInterval, timeout, condition)
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s; %s", err, diagnose())
+}
+
+// podsReady reports whether every Pod matching podLabels is scheduled, has
+// its containers ready and is itself Ready. Replica-count fields on a
+// Deployment/StatefulSet's status can report "available" from a Pod that
+// hasn't finished its readiness probe yet, so Wait also gates on the Pods'
+// own conditions directly.
+func podsReady(client kubernetes.Interface, namespace string, podLabels map[string]string) (bool, error) {
+	selector := labels.Set(podLabels).AsSelector().String()
+
+	pods, err := client.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return false, err
+	}
+	if len(pods.Items) == 0 {
+		return false, nil
+	}
+
+	for _, pod := range pods.Items {
+		conditions := pod.Status.Conditions
+		if !podConditionTrue(conditions, apiv1.PodScheduled) ||
+			!podConditionTrue(conditions, apiv1.ContainersReady) ||
+			!podConditionTrue(conditions, apiv1.PodReady) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func podConditionTrue(conditions []apiv1.PodCondition, conditionType apiv1.PodConditionType) bool {
+	for _, cond := range conditions {
+		if cond.Type == conditionType {
+			return cond.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func waitGone(client kubernetes.Interface, namespace string, podLabels map[string]string, timeout time.Duration) error {
+	selector := labels.Set(podLabels).AsSelector().String()
+
+	return wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		pods, err := client.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return false, err
+		}
+		return len(pods.Items) == 0, nil
+	})
+}
+
+// waitReplicaSetsAndPodsGone blocks until every ReplicaSet and Pod matching
+// podLabels has terminated, or timeout elapses. A Deployment's cascading
+// delete leaves its ReplicaSet(s) to clean up in addition to its Pods, so
+// deploymentWorkload.Gone waits on both instead of just waitGone's Pods.
+func waitReplicaSetsAndPodsGone(client kubernetes.Interface, namespace string, podLabels map[string]string, timeout time.Duration) error {
+	selector := labels.Set(podLabels).AsSelector().String()
+
+	return wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		replicaSets, err := client.AppsV1().ReplicaSets(namespace).List(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return false, err
+		}
+		if len(replicaSets.Items) > 0 {
+			return false, nil
+		}
+
+		pods, err := client.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return false, err
+		}
+		return len(pods.Items) == 0, nil
+	})
+}
+
+// diagnose collects Pod conditions, recent events and tail container logs
+// for every Pod matching podLabels, to help explain why a workload never
+// became ready.
+func diagnose(client kubernetes.Interface, namespace string, podLabels map[string]string) string {
+	selector := labels.Set(podLabels).AsSelector().String()
+
+	pods, err := client.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return fmt.Sprintf("could not list pods: %s", err)
+	}
+
+	var diag strings.Builder
+	for _, pod := range pods.Items {
+		fmt.Fprintf(&diag, "pod %s phase=%s", pod.Name, pod.Status.Phase)
+		for _, cond := range pod.Status.Conditions {
+			fmt.Fprintf(&diag, " %s=%s", cond.Type, cond.Status)
+		}
+
+		events, err := client.CoreV1().Events(namespace).List(metav1.ListOptions{
+			FieldSelector: fmt.Sprintf("involvedObject.name=%s", pod.Name),
+		})
+		if err == nil {
+			for _, event := range events.Items {
+				fmt.Fprintf(&diag, "; event %s: %s", event.Reason, event.Message)
+			}
+		}
+
+		for _, c := range pod.Spec.Containers {
+			logs, err := client.CoreV1().Pods(namespace).
+				GetLogs(pod.Name, &apiv1.PodLogOptions{Container: c.Name, TailLines: int64Ptr(20)}).
+				Do().Raw()
+			if err == nil {
+				fmt.Fprintf(&diag, "; logs[%s]: %s", c.Name, string(logs))
+			}
+		}
+
+		diag.WriteString("\n")
+	}
+
+	return diag.String()
+}
+
+func int64Ptr(i int64) *int64 { return &i }
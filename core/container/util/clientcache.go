@@ -0,0 +1,87 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package util
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	memory "k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// Cluster bundles the clients built from a single REST config, so callers
+// that need more than a plain Clientset (e.g. to query API discovery) don't
+// each rebuild it from the same config. Dynamic and Mapper back
+// kubernetescontroller/client.Client, which applies chart objects of
+// whatever kind they happen to be rather than a fixed set the Clientset
+// knows about statically.
+type Cluster struct {
+	Config    *rest.Config
+	Clientset kubernetes.Interface
+	Dynamic   dynamic.Interface
+	Discovery discovery.CachedDiscoveryInterface
+	Mapper    meta.RESTMapper
+}
+
+// ClientCache memoizes the Cluster built for a kubeconfig context, so that
+// concurrent Start/Stop calls for chaincodes addressed at the same cluster
+// reuse one Clientset and discovery cache instead of re-authenticating and
+// re-discovering on every call.
+type ClientCache struct {
+	mutex    sync.Mutex
+	clusters map[string]*Cluster
+}
+
+// NewClientCache returns an empty ClientCache.
+func NewClientCache() *ClientCache {
+	return &ClientCache{clusters: make(map[string]*Cluster)}
+}
+
+// Get returns the Cluster for kubeContext, building and caching it on first
+// use. An empty kubeContext addresses the default cluster (in-cluster
+// config, or the kubeconfig's own current-context).
+func (c *ClientCache) Get(kubeContext string) (*Cluster, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if cluster, ok := c.clusters[kubeContext]; ok {
+		return cluster, nil
+	}
+
+	cfg, err := NewRESTConfig(kubeContext)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cachedDiscovery := memory.NewMemCacheClient(clientset.Discovery())
+
+	cluster := &Cluster{
+		Config:    cfg,
+		Clientset: clientset,
+		Dynamic:   dynamicClient,
+		Discovery: cachedDiscovery,
+		Mapper:    restmapper.NewDeferredDiscoveryRESTMapper(cachedDiscovery),
+	}
+	c.clusters[kubeContext] = cluster
+
+	return cluster, nil
+}
@@ -28,25 +28,11 @@ import (
 // apiserverHost param is in the format of protocol://address:port/pathPrefix, e.g.http://localhost:8001.
 // kubeConfig location of kubeconfig file
 func NewKubernetesClient() (*kubernetes.Clientset, error) {
-
-	apiserverHost := viper.GetString("peer.kubernetes.endpoint")
-	kubeConfig := viper.GetString("peer.kubernetes.kubeconfig")
-
-	if kubeConfig == "" {
-		if home := homedir.HomeDir(); home != "" {
-			kubeConfig = filepath.Join(home, ".kube", "config")
-		}
-	}
-
-	cfg, err := buildConfigFromFlags(apiserverHost, kubeConfig)
+	cfg, err := NewRESTConfig("")
 	if err != nil {
 		return nil, err
 	}
 
-	cfg.QPS = defaultQPS
-	cfg.Burst = defaultBurst
-	cfg.ContentType = "application/vnd.kubernetes.protobuf"
-
 	glog.Infof("Creating API client for %s", cfg.Host)
 
 	client, err := kubernetes.NewForConfig(cfg)
@@ -65,6 +51,35 @@ func NewKubernetesClient() (*kubernetes.Clientset, error) {
 	return client, nil
 }
 
+// NewRESTConfig builds the REST config for kubeContext, the name of a
+// context within peer.kubernetes.kubeconfig (an empty kubeContext uses that
+// kubeconfig's current context). An empty peer.kubernetes.kubeconfig
+// defaults to $HOME/.kube/config. Only when no kubeconfig path results
+// (no home directory) and peer.kubernetes.endpoint is also empty does it
+// assume the peer is running inside the target cluster and discover the
+// Apiserver from there instead.
+func NewRESTConfig(kubeContext string) (*rest.Config, error) {
+	apiserverHost := viper.GetString("peer.kubernetes.endpoint")
+	kubeConfig := viper.GetString("peer.kubernetes.kubeconfig")
+
+	if kubeConfig == "" {
+		if home := homedir.HomeDir(); home != "" {
+			kubeConfig = filepath.Join(home, ".kube", "config")
+		}
+	}
+
+	cfg, err := buildConfigFromFlags(apiserverHost, kubeConfig, kubeContext)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.QPS = defaultQPS
+	cfg.Burst = defaultBurst
+	cfg.ContentType = "application/vnd.kubernetes.protobuf"
+
+	return cfg, nil
+}
+
 // Copy from:
 // https://github.com/kubernetes/ingress-nginx/blob/dcf4a4595eb558d9b8ed3eb48db08ad5c9d82a34/cmd/nginx/main.go#L245
 //
@@ -82,9 +97,12 @@ const (
 // Copy from:
 // https://github.com/kubernetes/ingress-nginx/blob/dcf4a4595eb558d9b8ed3eb48db08ad5c9d82a34/cmd/nginx/main.go#L256
 //
-// buildConfigFromFlags builds REST config based on master URL and kubeconfig path.
-// If both of them are empty then in cluster config is used.
-func buildConfigFromFlags(masterURL, kubeconfigPath string) (*rest.Config, error) {
+// buildConfigFromFlags builds REST config based on master URL, kubeconfig
+// path and kubeconfig context. If both masterURL and kubeconfigPath are
+// empty then in cluster config is used; kubeContext is only meaningful
+// when loading from a kubeconfig, and an empty kubeContext keeps that
+// kubeconfig's own current-context.
+func buildConfigFromFlags(masterURL, kubeconfigPath, kubeContext string) (*rest.Config, error) {
 	if kubeconfigPath == "" && masterURL == "" {
 		kubeconfig, err := rest.InClusterConfig()
 		if err != nil {
@@ -100,5 +118,6 @@ func buildConfigFromFlags(masterURL, kubeconfigPath string) (*rest.Config, error
 			ClusterInfo: clientcmdapi.Cluster{
 				Server: masterURL,
 			},
+			CurrentContext: kubeContext,
 		}).ClientConfig()
 }